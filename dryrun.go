@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pmezard/go-difflib/difflib"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+
+	"github.com/DamianZaremba/toolforge-volume-admission/server"
+)
+
+// runDryRun implements the "dry-run" subcommand: it runs a single pod
+// through the webhook locally, without standing up a server, and prints a
+// unified diff of the mutations that would be applied (or writes the raw
+// JSON patch to a file with -output).
+func runDryRun(args []string) error {
+	fs := flag.NewFlagSet("dry-run", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/toolforge-volume-admission/config.yaml", "path to the rule configuration file")
+	namespace := fs.String("namespace", "", "namespace of the pod to test")
+	podName := fs.String("pod", "", "name of a pod to fetch from the cluster and test")
+	podFile := fs.String("pod-file", "", "path to a YAML pod manifest to test, instead of fetching one from the cluster")
+	kubeconfig := fs.String("kubeconfig", "", "path to a kubeconfig file; defaults to the standard client-go loading rules")
+	output := fs.String("output", "", "if set, write the raw JSON patch to this path instead of printing a diff")
+	fs.Parse(args)
+
+	pod, err := loadDryRunPod(*podFile, *namespace, *podName, *kubeconfig)
+	if err != nil {
+		return fmt.Errorf("could not load pod: %w", err)
+	}
+
+	admission, err := server.NewVolumeAdmission(*configPath)
+	if err != nil {
+		return fmt.Errorf("could not load config from %v: %w", *configPath, err)
+	}
+
+	original, err := json.Marshal(pod)
+	if err != nil {
+		return fmt.Errorf("could not marshal pod: %w", err)
+	}
+
+	review := &admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("dry-run"),
+			Namespace: pod.Namespace,
+			Object:    runtime.RawExtension{Raw: original},
+		},
+	}
+	admission.HandleAdmission(review)
+
+	response := review.Response
+	if !response.Allowed {
+		message := "denied"
+		if response.Result != nil {
+			message = response.Result.Message
+		}
+		return fmt.Errorf("pod would be rejected: %s", message)
+	}
+
+	if len(response.Patch) == 0 {
+		fmt.Println("No changes would be made to this pod.")
+		return nil
+	}
+
+	if *output != "" {
+		return os.WriteFile(*output, response.Patch, 0o644)
+	}
+
+	patch, err := jsonpatch.DecodePatch(response.Patch)
+	if err != nil {
+		return fmt.Errorf("could not decode patch: %w", err)
+	}
+
+	patched, err := patch.Apply(original)
+	if err != nil {
+		return fmt.Errorf("could not apply patch: %w", err)
+	}
+
+	return printUnifiedDiff(original, patched)
+}
+
+// loadDryRunPod reads the pod under test either from a YAML manifest on
+// disk, or by fetching it live from the cluster identified by kubeconfig.
+func loadDryRunPod(podFile, namespace, podName, kubeconfig string) (*corev1.Pod, error) {
+	if podFile != "" {
+		data, err := os.ReadFile(podFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var pod corev1.Pod
+		if err := yaml.Unmarshal(data, &pod); err != nil {
+			return nil, err
+		}
+		if pod.Namespace == "" {
+			pod.Namespace = namespace
+		}
+
+		return &pod, nil
+	}
+
+	if namespace == "" || podName == "" {
+		return nil, fmt.Errorf("either -pod-file, or both -namespace and -pod, must be set")
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientset.CoreV1().Pods(namespace).Get(context.Background(), podName, metav1.GetOptions{})
+}
+
+// printUnifiedDiff prints a unified diff between the original and patched
+// pod, serialized as indented JSON so the diff is readable.
+func printUnifiedDiff(original, patched []byte) error {
+	before, err := prettyJSON(original)
+	if err != nil {
+		return err
+	}
+	after, err := prettyJSON(patched)
+	if err != nil {
+		return err
+	}
+
+	diff := difflib.UnifiedDiff{
+		A:        difflib.SplitLines(before),
+		B:        difflib.SplitLines(after),
+		FromFile: "original",
+		ToFile:   "mutated",
+		Context:  3,
+	}
+
+	text, err := difflib.GetUnifiedDiffString(diff)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(text)
+	return nil
+}
+
+func prettyJSON(data []byte) (string, error) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTempPod(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "pod.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("could not write temp pod manifest: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadDryRunPodFromFile(t *testing.T) {
+	path := writeTempPod(t, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test-pod
+  namespace: tool-test
+spec:
+  containers:
+    - name: main
+      image: example.org/test:latest
+`)
+
+	pod, err := loadDryRunPod(path, "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pod.Name != "test-pod" || pod.Namespace != "tool-test" {
+		t.Errorf("unexpected pod: %+v", pod.ObjectMeta)
+	}
+}
+
+func TestLoadDryRunPodFromFileFillsInNamespace(t *testing.T) {
+	path := writeTempPod(t, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test-pod
+spec:
+  containers:
+    - name: main
+      image: example.org/test:latest
+`)
+
+	pod, err := loadDryRunPod(path, "tool-test", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pod.Namespace != "tool-test" {
+		t.Errorf("expected the -namespace flag to fill in a missing namespace, got %q", pod.Namespace)
+	}
+}
+
+func TestLoadDryRunPodRequiresPodFileOrNamespaceAndPod(t *testing.T) {
+	if _, err := loadDryRunPod("", "", "", ""); err == nil {
+		t.Error("expected an error when neither -pod-file nor -namespace/-pod are set")
+	}
+}
+
+func TestPrintUnifiedDiffShowsAddedLines(t *testing.T) {
+	original := []byte(`{"a":1}`)
+	patched := []byte(`{"a":1,"b":2}`)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("could not create pipe: %v", err)
+	}
+	os.Stdout = w
+	err = printUnifiedDiff(original, patched)
+	w.Close()
+	os.Stdout = stdout
+	out, _ := io.ReadAll(r)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(string(out), `+  "b": 2`) {
+		t.Errorf("expected the diff to show the added \"b\" line, got:\n%s", out)
+	}
+}
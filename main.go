@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/DamianZaremba/toolforge-volume-admission/server"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dry-run" {
+		if err := runDryRun(os.Args[2:]); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	configPath := flag.String("config", "/etc/toolforge-volume-admission/config.yaml", "path to the rule configuration file")
+	listenAddr := flag.String("listen", ":8443", "address to listen on")
+	certFile := flag.String("tls-cert", "", "TLS certificate file to serve with")
+	keyFile := flag.String("tls-key", "", "TLS key file to serve with")
+	metricsListenAddr := flag.String("metrics.listen", ":9090", "address to expose Prometheus metrics on")
+	auditLogPath := flag.String("audit-log", "", "path to write JSON audit records to; defaults to stdout")
+	flag.Parse()
+
+	admission, err := server.NewVolumeAdmission(*configPath)
+	if err != nil {
+		logrus.Fatalf("Could not load config from %v: %v", *configPath, err)
+	}
+
+	if *auditLogPath == "" {
+		admission.Audit = server.NewAuditLogger(os.Stdout)
+	} else {
+		auditFile, err := os.OpenFile(*auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			logrus.Fatalf("Could not open audit log %v: %v", *auditLogPath, err)
+		}
+		defer auditFile.Close()
+		admission.Audit = server.NewAuditLogger(auditFile)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go admission.WatchConfig(stop)
+
+	metricsServer := server.GetMetricsServer(*metricsListenAddr)
+	go func() {
+		logrus.Infof("Exposing metrics on %v", *metricsListenAddr)
+		logrus.Fatal(metricsServer.ListenAndServe())
+	}()
+
+	srv := server.GetAdmissionControllerServer(admission, *listenAddr)
+
+	if *certFile != "" && *keyFile != "" {
+		logrus.Infof("Listening on %v (TLS)", *listenAddr)
+		logrus.Fatal(srv.ListenAndServeTLS(*certFile, *keyFile))
+	} else {
+		logrus.Infof("Listening on %v (plain HTTP)", *listenAddr)
+		logrus.Fatal(srv.ListenAndServe())
+	}
+}
@@ -2,11 +2,21 @@ package server
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/json"
 )
@@ -21,6 +31,19 @@ const (
 	MountAll = "all"
 	// MountNone is the option for pods with no volumes mounted.
 	MountNone = "none"
+
+	// ToolUIDLabel carries the tool's numeric UID, as published by the
+	// kubeusers controller, used to derive securityContext defaults.
+	ToolUIDLabel = "toolforge.org/uid"
+
+	// MemRequestLabel overrides the configured default memory request.
+	MemRequestLabel = "toolforge.org/mem-request"
+	// MemLimitLabel overrides the configured default memory limit.
+	MemLimitLabel = "toolforge.org/mem-limit"
+	// CPURequestLabel overrides the configured default CPU request.
+	CPURequestLabel = "toolforge.org/cpu-request"
+	// CPULimitLabel overrides the configured default CPU limit.
+	CPULimitLabel = "toolforge.org/cpu-limit"
 )
 
 // PatchOperation describes an operation done to modify a Kubernetes
@@ -38,11 +61,232 @@ type Volume struct {
 	Path     string              `json:"path"`
 	Type     corev1.HostPathType `json:"type"`
 	ReadOnly bool                `json:"readOnly"`
+
+	// Source selects which corev1.VolumeSource backs this volume. It
+	// defaults to VolumeSourceHostPath so existing configs keep working
+	// unchanged.
+	Source VolumeSourceType `json:"source,omitempty"`
+	// PVC configures the persistentVolumeClaim source, used when
+	// Source == VolumeSourcePVC.
+	PVC *PVCSource `json:"persistentVolumeClaim,omitempty"`
+	// CSI configures the csi source, used when Source == VolumeSourceCSI.
+	CSI *CSISource `json:"csi,omitempty"`
+}
+
+// volumeSource builds the corev1.VolumeSource for this volume, rendering
+// toolName into any PVC claim name template.
+func (v Volume) volumeSource(toolName string) corev1.VolumeSource {
+	switch v.Source {
+	case VolumeSourcePVC:
+		claimName := v.Name
+		if v.PVC != nil && v.PVC.ClaimNameTemplate != "" {
+			claimName = fmt.Sprintf(v.PVC.ClaimNameTemplate, toolName)
+		}
+
+		return corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: claimName,
+				ReadOnly:  v.ReadOnly,
+			},
+		}
+	case VolumeSourceCSI:
+		csi := &corev1.CSIVolumeSource{ReadOnly: &v.ReadOnly}
+		if v.CSI != nil {
+			csi.Driver = v.CSI.Driver
+			csi.VolumeAttributes = v.CSI.VolumeAttributes
+		}
+
+		return corev1.VolumeSource{CSI: csi}
+	default:
+		volumeType := v.Type
+		return corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{
+				Path: v.Path,
+				Type: &volumeType,
+			},
+		}
+	}
+}
+
+// isNFSNodeBound reports whether this volume requires scheduling onto a
+// node with NFS mounted, which is only true for the legacy hostPath mode.
+func (v Volume) isNFSNodeBound() bool {
+	return v.Source == "" || v.Source == VolumeSourceHostPath
 }
 
-// VolumeAdmission type is what does all the magic
+// VolumeAdmission type is what does all the magic. Its rules come from a
+// Config loaded from disk, which can be swapped out at runtime via Reload
+// (see WatchConfig). Some behavior is built in and not configurable: the
+// HOME and TOOL_DATA_DIR env vars, the NO_HOME handling, and the
+// kubernetes.wmcloud.org/nfs-mounted nodeSelector for hostPath volumes.
 type VolumeAdmission struct {
-	Volumes []Volume
+	configPath string
+	config     atomic.Value // holds *Config
+
+	// Audit, if set, receives one AuditRecord per AdmissionReview handled.
+	Audit *AuditLogger
+}
+
+// NewVolumeAdmission loads the rule configuration found at configPath and
+// returns a VolumeAdmission ready to handle admission requests.
+func NewVolumeAdmission(configPath string) (*VolumeAdmission, error) {
+	admission := &VolumeAdmission{configPath: configPath}
+
+	if err := admission.Reload(); err != nil {
+		return nil, err
+	}
+
+	return admission, nil
+}
+
+// Config returns the rule configuration currently in effect.
+func (admission *VolumeAdmission) Config() *Config {
+	return admission.config.Load().(*Config)
+}
+
+// Reload re-reads the configuration file from disk and, if it parses
+// correctly, swaps it in atomically. A bad config on disk never takes down
+// a previously-working admission controller.
+func (admission *VolumeAdmission) Reload() error {
+	config, err := LoadConfig(admission.configPath)
+	if err != nil {
+		return err
+	}
+
+	admission.config.Store(config)
+	logrus.Infof("Loaded %d rule(s) from %s", len(config.Rules), admission.configPath)
+
+	return nil
+}
+
+// WatchConfig blocks, reloading the configuration whenever its backing file
+// changes on disk or the process receives SIGHUP, until stop is closed. It
+// is meant to be run in its own goroutine.
+func (admission *VolumeAdmission) WatchConfig(stop <-chan struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("Could not start config watcher, falling back to SIGHUP-only reload: %v", err)
+	} else {
+		defer watcher.Close()
+
+		if err := watcher.Add(filepath.Dir(admission.configPath)); err != nil {
+			logrus.Errorf("Could not watch directory of %s: %v", admission.configPath, err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events <-chan fsnotify.Event
+	var errors <-chan error
+	if watcher != nil {
+		events = watcher.Events
+		errors = watcher.Errors
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case sig := <-hup:
+			logrus.Infof("Received %v, reloading config", sig)
+			admission.reloadOrLog()
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(admission.configPath) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			logrus.Infof("Config file %s changed, reloading", event.Name)
+			admission.reloadOrLog()
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			logrus.Errorf("Config watcher error: %v", err)
+		}
+	}
+}
+
+func (admission *VolumeAdmission) reloadOrLog() {
+	if err := admission.Reload(); err != nil {
+		logrus.Errorf("Could not reload config, keeping previous rules in effect: %v", err)
+	}
+}
+
+// classifyDenialReason turns a human-readable denial message, as set on
+// review.Response.Result.Message, into a short, stable label suitable for a
+// metrics label value.
+func classifyDenialReason(message string) string {
+	switch {
+	case strings.Contains(message, "Only tools can have"):
+		return "non-tool-namespace"
+	case strings.Contains(message, "No hostPath volumes allowed"):
+		return "disallowed-hostpath"
+	case strings.Contains(message, "exceeds the maximum"):
+		return "resource-limit-exceeded"
+	case strings.Contains(message, "label"):
+		return "invalid-label"
+	default:
+		return "other"
+	}
+}
+
+// recordDecision updates the Prometheus metrics and, if configured, writes
+// an audit record for the AdmissionReview that HandleAdmission just handled.
+func (admission *VolumeAdmission) recordDecision(req *admissionv1.AdmissionRequest, review *admissionv1.AdmissionReview, latency time.Duration) {
+	response := review.Response
+	if response == nil {
+		return
+	}
+
+	admissionRequestDurationSeconds.Observe(latency.Seconds())
+	admissionRequestsTotal.WithLabelValues(strconv.FormatBool(response.Allowed)).Inc()
+
+	var patches []PatchOperation
+	if len(response.Patch) > 0 {
+		if err := json.Unmarshal(response.Patch, &patches); err != nil {
+			logrus.Errorf("Could not unmarshal patch for metrics/audit: %v", err)
+		} else {
+			admissionPatchOperations.Observe(float64(len(patches)))
+		}
+	}
+
+	reason := ""
+	if !response.Allowed {
+		message := ""
+		if response.Result != nil {
+			message = response.Result.Message
+		}
+		reason = classifyDenialReason(message)
+		admissionDeniedTotal.WithLabelValues(reason).Inc()
+	}
+
+	if admission.Audit == nil || req == nil {
+		return
+	}
+
+	var pod corev1.Pod
+	_ = json.Unmarshal(req.Object.Raw, &pod)
+
+	admission.Audit.Log(AuditRecord{
+		UID:         string(req.UID),
+		Namespace:   req.Namespace,
+		PodName:     pod.Name,
+		User:        req.UserInfo.Username,
+		MountConfig: getLabelOrDefault(pod, MountConfigLabel, MountAll),
+		Patches:     patches,
+		Allowed:     response.Allowed,
+		Reason:      reason,
+		LatencyMS:   float64(latency.Microseconds()) / 1000,
+	})
 }
 
 func getLabelOrDefault(pod corev1.Pod, label string, defaultValue string) string {
@@ -74,19 +318,143 @@ func hasVolumeByName(pod corev1.Pod, name string) bool {
 	return false
 }
 
-func hasEnvVarSet(container *corev1.Container, envVar string) bool {
-	for _, env := range container.Env {
+func envVarIndex(container *corev1.Container, envVar string) int {
+	for i, env := range container.Env {
 		if env.Name == envVar {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasEnvVarSet(container *corev1.Container, envVar string) bool {
+	return envVarIndex(container, envVar) != -1
+}
+
+// jsonPointerEscape escapes a map key for use as a JSON Patch path segment,
+// per RFC 6901 (~ becomes ~0, / becomes ~1).
+func jsonPointerEscape(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+func hasContainerByName(containers []corev1.Container, name string) bool {
+	for _, container := range containers {
+		if container.Name == name {
 			return true
 		}
 	}
+
+	return false
+}
+
+// mergeResourceList copies every entry of src into dst, overwriting any
+// existing entries with the same resource name.
+func mergeResourceList(dst, src corev1.ResourceList) {
+	for name, quantity := range src {
+		dst[name] = quantity
+	}
+}
+
+// labelResourceOverrides parses the toolforge.org/{mem,cpu}-{request,limit}
+// labels, if present, into the corresponding ResourceLists.
+func labelResourceOverrides(pod corev1.Pod) (requests corev1.ResourceList, limits corev1.ResourceList, err error) {
+	requests = corev1.ResourceList{}
+	limits = corev1.ResourceList{}
+
+	fields := []struct {
+		label string
+		list  corev1.ResourceList
+		name  corev1.ResourceName
+	}{
+		{MemRequestLabel, requests, corev1.ResourceMemory},
+		{MemLimitLabel, limits, corev1.ResourceMemory},
+		{CPURequestLabel, requests, corev1.ResourceCPU},
+		{CPULimitLabel, limits, corev1.ResourceCPU},
+	}
+
+	for _, field := range fields {
+		value, exists := pod.ObjectMeta.Labels[field.label]
+		if !exists {
+			continue
+		}
+
+		quantity, parseErr := resource.ParseQuantity(value)
+		if parseErr != nil {
+			return nil, nil, fmt.Errorf("invalid %s label %q: %w", field.label, value, parseErr)
+		}
+
+		field.list[field.name] = quantity
+	}
+
+	return requests, limits, nil
+}
+
+// applySecurityContextDefaults derives securityContext.runAsUser/fsGroup
+// from ToolUIDLabel, appending the necessary patches to *patches and
+// updating pod in place so later rules see the change.
+func applySecurityContextDefaults(pod *corev1.Pod, defaults *PodSecurityContextDefaults, patches *[]PatchOperation) error {
+	if !defaults.RunAsUserFromUID && !defaults.FSGroupFromUID {
+		return nil
+	}
+
+	uidLabel, exists := pod.ObjectMeta.Labels[ToolUIDLabel]
+	if !exists {
+		return nil
+	}
+
+	uid, err := strconv.ParseInt(uidLabel, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s label %q: %w", ToolUIDLabel, uidLabel, err)
+	}
+
+	if pod.Spec.SecurityContext == nil {
+		*patches = append(*patches, PatchOperation{
+			Op:    "add",
+			Path:  "/spec/securityContext",
+			Value: corev1.PodSecurityContext{},
+		})
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+
+	if defaults.RunAsUserFromUID && pod.Spec.SecurityContext.RunAsUser == nil {
+		*patches = append(*patches, PatchOperation{
+			Op:    "add",
+			Path:  "/spec/securityContext/runAsUser",
+			Value: uid,
+		})
+		pod.Spec.SecurityContext.RunAsUser = &uid
+	}
+
+	if defaults.FSGroupFromUID && pod.Spec.SecurityContext.FSGroup == nil {
+		*patches = append(*patches, PatchOperation{
+			Op:    "add",
+			Path:  "/spec/securityContext/fsGroup",
+			Value: uid,
+		})
+		pod.Spec.SecurityContext.FSGroup = &uid
+	}
+
+	return nil
+}
+
+func hasToleration(pod corev1.Pod, toleration corev1.Toleration) bool {
+	for _, existing := range pod.Spec.Tolerations {
+		if reflect.DeepEqual(existing, toleration) {
+			return true
+		}
+	}
+
 	return false
 }
 
 // HandleAdmission has all the webhook logic to possibly mount volumes
 // to containers if needed
 func (admission *VolumeAdmission) HandleAdmission(review *admissionv1.AdmissionReview) {
+	start := time.Now()
 	req := review.Request
+	defer func() {
+		admission.recordDecision(req, review, time.Since(start))
+	}()
 
 	var pod corev1.Pod
 	err := json.Unmarshal(req.Object.Raw, &pod)
@@ -166,6 +534,186 @@ func (admission *VolumeAdmission) HandleAdmission(review *admissionv1.AdmissionR
 		})
 	}
 
+	rules := admission.Config().MatchingRules(pod, req.Namespace)
+	toolName := strings.Replace(req.Namespace, "tool-", "", 1)
+
+	resourceRequests := corev1.ResourceList{}
+	resourceLimits := corev1.ResourceList{}
+	maxResourceLimits := corev1.ResourceList{}
+	for _, rule := range rules {
+		if rule.Mutations.Resources == nil {
+			continue
+		}
+		mergeResourceList(resourceRequests, rule.Mutations.Resources.Requests)
+		mergeResourceList(resourceLimits, rule.Mutations.Resources.Limits)
+		mergeResourceList(maxResourceLimits, rule.Mutations.Resources.MaxLimits)
+	}
+
+	labelRequests, labelLimits, err := labelResourceOverrides(pod)
+	if err != nil {
+		review.Response = &admissionv1.AdmissionResponse{
+			UID:     review.Request.UID,
+			Allowed: false,
+			Result:  &metav1.Status{Message: err.Error()},
+		}
+		return
+	}
+	mergeResourceList(resourceRequests, labelRequests)
+	mergeResourceList(resourceLimits, labelLimits)
+
+	// Resource defaults and the hard-cap rejection below are enforced
+	// regardless of MountNone: that label only opts a pod out of having
+	// tool storage mounted, not out of the resource policy this webhook
+	// exists to enforce.
+	for i, container := range pod.Spec.Containers {
+		if (len(resourceRequests) > 0 || len(resourceLimits) > 0) && reflect.DeepEqual(container.Resources, corev1.ResourceRequirements{}) {
+			patches = append(patches, PatchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/containers/%d/resources", i),
+				Value: corev1.ResourceRequirements{},
+			})
+		}
+
+		if len(resourceRequests) > 0 && container.Resources.Requests == nil {
+			patches = append(patches, PatchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/containers/%d/resources/requests", i),
+				Value: corev1.ResourceList{},
+			})
+		}
+		for name, quantity := range resourceRequests {
+			if _, exists := container.Resources.Requests[name]; exists {
+				continue
+			}
+			patches = append(patches, PatchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/containers/%d/resources/requests/%s", i, jsonPointerEscape(string(name))),
+				Value: quantity,
+			})
+		}
+
+		if len(resourceLimits) > 0 && container.Resources.Limits == nil {
+			patches = append(patches, PatchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/containers/%d/resources/limits", i),
+				Value: corev1.ResourceList{},
+			})
+		}
+		for name, quantity := range resourceLimits {
+			if _, exists := container.Resources.Limits[name]; exists {
+				continue
+			}
+			patches = append(patches, PatchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/containers/%d/resources/limits/%s", i, jsonPointerEscape(string(name))),
+				Value: quantity,
+			})
+		}
+
+		for name, max := range maxResourceLimits {
+			effective, exists := container.Resources.Limits[name]
+			if !exists {
+				overridden, ok := resourceLimits[name]
+				if !ok {
+					continue
+				}
+				effective = overridden
+			}
+
+			if effective.Cmp(max) > 0 {
+				review.Response = &admissionv1.AdmissionResponse{
+					UID:     review.Request.UID,
+					Allowed: false,
+					Result: &metav1.Status{
+						Message: fmt.Sprintf(
+							"container %s requests %s=%s, which exceeds the maximum of %s",
+							container.Name, name, effective.String(), max.String(),
+						),
+					},
+				}
+				return
+			}
+		}
+	}
+
+	// priorityClass/runtimeClass/securityContext defaults are likewise
+	// pod-wide policy, not volume mounting, so they also apply regardless
+	// of MountNone.
+	for _, rule := range rules {
+		if rule.Mutations.PriorityClassName != "" && pod.Spec.PriorityClassName == "" {
+			patches = append(patches, PatchOperation{
+				Op:    "add",
+				Path:  "/spec/priorityClassName",
+				Value: rule.Mutations.PriorityClassName,
+			})
+			pod.Spec.PriorityClassName = rule.Mutations.PriorityClassName
+		}
+
+		if rule.Mutations.RuntimeClassName != "" && pod.Spec.RuntimeClassName == nil {
+			runtimeClassName := rule.Mutations.RuntimeClassName
+			patches = append(patches, PatchOperation{
+				Op:    "add",
+				Path:  "/spec/runtimeClassName",
+				Value: runtimeClassName,
+			})
+			pod.Spec.RuntimeClassName = &runtimeClassName
+		}
+
+		if rule.Mutations.PodSecurityContext != nil {
+			if err := applySecurityContextDefaults(&pod, rule.Mutations.PodSecurityContext, &patches); err != nil {
+				review.Response = &admissionv1.AdmissionResponse{
+					UID:     review.Request.UID,
+					Allowed: false,
+					Result:  &metav1.Status{Message: err.Error()},
+				}
+				return
+			}
+		}
+	}
+
+	// Sidecars (e.g. logging/metrics helpers) are injected regardless of
+	// MountNone too: they're opted into per-pod via a label, independently
+	// of whether the pod wants tool storage mounted.
+	for _, rule := range rules {
+		for _, sidecar := range rule.Mutations.Sidecars {
+			container := sidecar.asContainer()
+
+			if sidecar.Init {
+				if hasContainerByName(pod.Spec.InitContainers, sidecar.Name) {
+					continue
+				}
+
+				if pod.Spec.InitContainers == nil {
+					patches = append(patches, PatchOperation{
+						Op:    "add",
+						Path:  "/spec/initContainers",
+						Value: []corev1.Container{},
+					})
+					pod.Spec.InitContainers = []corev1.Container{}
+				}
+
+				patches = append(patches, PatchOperation{
+					Op:    "add",
+					Path:  "/spec/initContainers/-",
+					Value: container,
+				})
+				pod.Spec.InitContainers = append(pod.Spec.InitContainers, *container)
+				continue
+			}
+
+			if hasContainerByName(pod.Spec.Containers, sidecar.Name) {
+				continue
+			}
+
+			patches = append(patches, PatchOperation{
+				Op:    "add",
+				Path:  "/spec/containers/-",
+				Value: container,
+			})
+			pod.Spec.Containers = append(pod.Spec.Containers, *container)
+		}
+	}
+
 	if mountConfig == MountNone {
 		patchType := admissionv1.PatchTypeJSONPatch
 		response := &admissionv1.AdmissionResponse{
@@ -205,46 +753,50 @@ func (admission *VolumeAdmission) HandleAdmission(review *admissionv1.AdmissionR
 		}
 	}
 
-	for _, volume := range admission.Volumes {
-		if hasVolumeByName(pod, volume.Name) {
-			continue
-		}
+	needsNFSNode := false
 
-		var volumeType = volume.Type
-		patch := PatchOperation{
-			Op:   "add",
-			Path: "/spec/volumes/-",
-			Value: &corev1.Volume{
-				VolumeSource: corev1.VolumeSource{
-					HostPath: &corev1.HostPathVolumeSource{
-						Path: volume.Path,
-						Type: &volumeType,
-					},
-				},
-				Name: volume.Name,
-			},
-		}
-		patches = append(patches, patch)
+	for _, rule := range rules {
+		for _, volume := range rule.Mutations.Volumes {
+			if volume.isNFSNodeBound() {
+				needsNFSNode = true
+			}
 
-		for i, container := range pod.Spec.Containers {
-			// Ignore pods that already have this volume mounted
-			if hasMountByPath(container, volume.Path) {
+			if hasVolumeByName(pod, volume.Name) {
 				continue
 			}
 
 			patch := PatchOperation{
 				Op:   "add",
-				Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", i),
-				Value: &corev1.VolumeMount{
-					MountPath: volume.Path,
-					Name:      volume.Name,
-					ReadOnly:  volume.ReadOnly,
+				Path: "/spec/volumes/-",
+				Value: &corev1.Volume{
+					VolumeSource: volume.volumeSource(toolName),
+					Name:         volume.Name,
 				},
 			}
 			patches = append(patches, patch)
+
+			for i, container := range pod.Spec.Containers {
+				// Ignore pods that already have this volume mounted
+				if hasMountByPath(container, volume.Path) {
+					continue
+				}
+
+				patch := PatchOperation{
+					Op:   "add",
+					Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", i),
+					Value: &corev1.VolumeMount{
+						MountPath: volume.Path,
+						Name:      volume.Name,
+						ReadOnly:  volume.ReadOnly,
+					},
+				}
+				patches = append(patches, patch)
+			}
 		}
 	}
 
+	removedWorkingDir := make(map[int]bool)
+
 	for i, container := range pod.Spec.Containers {
 		// Initialize the env entry itself, otherwise further patches will fail
 		if container.Env == nil {
@@ -265,17 +817,33 @@ func (admission *VolumeAdmission) HandleAdmission(review *admissionv1.AdmissionR
 		// If $NO_HOME is set, don't add any HOME, and remove any workingDir to let the image decide
 		if hasEnvVarSet(&container, "NO_HOME") {
 			skipSettingHome = true
-			if container.WorkingDir != "" {
+			if container.WorkingDir != "" && !removedWorkingDir[i] {
 				patch := PatchOperation{
 					Op:   "remove",
 					Path: fmt.Sprintf("/spec/containers/%d/workingDir", i),
 				}
 				patches = append(patches, patch)
+				removedWorkingDir[i] = true
 			}
 		}
 
-		toolName := strings.Replace(req.Namespace, "tool-", "", 1)
 		toolHome := fmt.Sprintf("/data/project/%v", toolName)
+
+		// Track name -> index in the container's env list as it's extended
+		// below, so a rule's Env entries can target a var added earlier in
+		// this same loop (e.g. HOME) instead of only the container's
+		// original env. seenRuleEnv applies the same first-rule-wins
+		// convention used elsewhere for overlapping rules (e.g.
+		// PriorityClassName, NodeSelector): once one rule has set a given
+		// var, later rules setting the same var are skipped entirely, so
+		// overlapping rules stay idempotent instead of each adding a patch.
+		envIndex := make(map[string]int, len(container.Env))
+		for idx, e := range container.Env {
+			envIndex[e.Name] = idx
+		}
+		nextEnvIndex := len(container.Env)
+		seenRuleEnv := make(map[string]bool)
+
 		if !skipSettingHome {
 			patch := PatchOperation{
 				Op:    "add",
@@ -283,6 +851,8 @@ func (admission *VolumeAdmission) HandleAdmission(review *admissionv1.AdmissionR
 				Value: &corev1.EnvVar{Name: "HOME", Value: toolHome},
 			}
 			patches = append(patches, patch)
+			envIndex["HOME"] = nextEnvIndex
+			nextEnvIndex++
 		}
 
 		// Always add the TOOL_DATA_DIR env var
@@ -292,10 +862,59 @@ func (admission *VolumeAdmission) HandleAdmission(review *admissionv1.AdmissionR
 			Value: &corev1.EnvVar{Name: "TOOL_DATA_DIR", Value: toolHome},
 		}
 		patches = append(patches, patch)
+		envIndex["TOOL_DATA_DIR"] = nextEnvIndex
+		nextEnvIndex++
+
+		for _, rule := range rules {
+			for _, env := range rule.Mutations.Env {
+				if seenRuleEnv[env.Name] {
+					continue
+				}
+				seenRuleEnv[env.Name] = true
+
+				if idx, ok := envIndex[env.Name]; ok {
+					patch := PatchOperation{
+						Op:    "replace",
+						Path:  fmt.Sprintf("/spec/containers/%d/env/%d", i, idx),
+						Value: env,
+					}
+					patches = append(patches, patch)
+				} else {
+					patch := PatchOperation{
+						Op:    "add",
+						Path:  fmt.Sprintf("/spec/containers/%d/env/-", i),
+						Value: env,
+					}
+					patches = append(patches, patch)
+					envIndex[env.Name] = nextEnvIndex
+					nextEnvIndex++
+				}
+			}
+		}
+
+		if !removedWorkingDir[i] && container.WorkingDir != "" {
+			for _, rule := range rules {
+				if rule.Mutations.RemoveWorkingDir {
+					patch := PatchOperation{
+						Op:   "remove",
+						Path: fmt.Sprintf("/spec/containers/%d/workingDir", i),
+					}
+					patches = append(patches, patch)
+					removedWorkingDir[i] = true
+					break
+				}
+			}
+		}
+	}
 
+	needsNodeSelector := needsNFSNode
+	for _, rule := range rules {
+		if len(rule.Mutations.NodeSelector) > 0 {
+			needsNodeSelector = true
+		}
 	}
 
-	if pod.Spec.NodeSelector == nil {
+	if pod.Spec.NodeSelector == nil && needsNodeSelector {
 		pod.Spec.NodeSelector = map[string]string{}
 		patch := PatchOperation{
 			Op:    "add",
@@ -306,7 +925,9 @@ func (admission *VolumeAdmission) HandleAdmission(review *admissionv1.AdmissionR
 		patches = append(patches, patch)
 	}
 
-	if _, exists := pod.Spec.NodeSelector["kubernetes.wmcloud.org/nfs-mounted"]; !exists {
+	// Only pods backed by a hostPath/NFS volume need to be scheduled onto a
+	// node that has the NFS share mounted; PVC/CSI backed volumes do not.
+	if _, exists := pod.Spec.NodeSelector["kubernetes.wmcloud.org/nfs-mounted"]; needsNFSNode && !exists {
 		patch := PatchOperation{
 			Op:    "add",
 			Path:  "/spec/nodeSelector/kubernetes.wmcloud.org~1nfs-mounted",
@@ -316,6 +937,54 @@ func (admission *VolumeAdmission) HandleAdmission(review *admissionv1.AdmissionR
 		patches = append(patches, patch)
 	}
 
+	for _, rule := range rules {
+		for key, value := range rule.Mutations.NodeSelector {
+			if _, exists := pod.Spec.NodeSelector[key]; exists {
+				continue
+			}
+
+			patch := PatchOperation{
+				Op:    "add",
+				Path:  "/spec/nodeSelector/" + jsonPointerEscape(key),
+				Value: value,
+			}
+			patches = append(patches, patch)
+			pod.Spec.NodeSelector[key] = value
+		}
+	}
+
+	if pod.Spec.Tolerations == nil {
+		needsInit := false
+		for _, rule := range rules {
+			if len(rule.Mutations.Tolerations) > 0 {
+				needsInit = true
+				break
+			}
+		}
+		if needsInit {
+			patches = append(patches, PatchOperation{
+				Op:    "add",
+				Path:  "/spec/tolerations",
+				Value: []corev1.Toleration{},
+			})
+		}
+	}
+
+	for _, rule := range rules {
+		for _, toleration := range rule.Mutations.Tolerations {
+			if hasToleration(pod, toleration) {
+				continue
+			}
+
+			patches = append(patches, PatchOperation{
+				Op:    "add",
+				Path:  "/spec/tolerations/-",
+				Value: toleration,
+			})
+			pod.Spec.Tolerations = append(pod.Spec.Tolerations, toleration)
+		}
+	}
+
 	patchType := admissionv1.PatchTypeJSONPatch
 
 	response := &admissionv1.AdmissionResponse{
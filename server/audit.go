@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AuditRecord is a structured JSON record of a single admission decision,
+// emitted by AuditLogger.
+type AuditRecord struct {
+	UID         string           `json:"uid"`
+	Namespace   string           `json:"namespace"`
+	PodName     string           `json:"podName"`
+	User        string           `json:"user"`
+	MountConfig string           `json:"mountConfig"`
+	Patches     []PatchOperation `json:"patches,omitempty"`
+	Allowed     bool             `json:"allowed"`
+	Reason      string           `json:"reason,omitempty"`
+	LatencyMS   float64          `json:"latencyMs"`
+}
+
+// AuditLogger writes one JSON AuditRecord per line to a configured sink,
+// e.g. stdout or a file. A nil *AuditLogger is valid and simply discards
+// every record, so callers that don't care about auditing can leave it unset.
+type AuditLogger struct {
+	out io.Writer
+}
+
+// NewAuditLogger returns an AuditLogger writing newline-delimited JSON to out.
+func NewAuditLogger(out io.Writer) *AuditLogger {
+	return &AuditLogger{out: out}
+}
+
+// Log writes record to the sink, if one is configured.
+func (l *AuditLogger) Log(record AuditRecord) {
+	if l == nil || l.out == nil {
+		return
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		logrus.Errorf("Could not marshal audit record: %v", err)
+		return
+	}
+
+	if _, err := fmt.Fprintln(l.out, string(data)); err != nil {
+		logrus.Errorf("Could not write audit record: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAuditLoggerWritesOneJSONLinePerRecord(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewAuditLogger(&buf)
+
+	logger.Log(AuditRecord{
+		UID:         "abc-123",
+		Namespace:   "tool-test",
+		PodName:     "test-pod",
+		User:        "tool-test",
+		MountConfig: MountAll,
+		Allowed:     true,
+		LatencyMS:   1.5,
+	})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected exactly one line, got %d: %q", len(lines), buf.String())
+	}
+
+	var record AuditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("could not unmarshal audit record: %v", err)
+	}
+
+	if record.UID != "abc-123" || record.Namespace != "tool-test" || !record.Allowed {
+		t.Errorf("unexpected audit record: %+v", record)
+	}
+}
+
+func TestNilAuditLoggerDiscardsRecords(t *testing.T) {
+	var logger *AuditLogger
+
+	// Should not panic when no sink has been configured.
+	logger.Log(AuditRecord{UID: "abc-123"})
+}
+
+func TestClassifyDenialReason(t *testing.T) {
+	cases := []struct {
+		message string
+		want    string
+	}{
+		{"Only tools can have the toolforge.org/whatever label", "non-tool-namespace"},
+		{"No hostPath volumes allowed outside of the default set", "disallowed-hostpath"},
+		{"requested memory limit exceeds the maximum allowed", "resource-limit-exceeded"},
+		{"invalid value for label toolforge.org/mount-config", "invalid-label"},
+		{"something else went wrong", "other"},
+	}
+
+	for _, c := range cases {
+		if got := classifyDenialReason(c.message); got != c.want {
+			t.Errorf("classifyDenialReason(%q) = %q, want %q", c.message, got, c.want)
+		}
+	}
+}
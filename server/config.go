@@ -0,0 +1,251 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Selector describes which pods a Rule applies to. A zero-value Selector
+// matches every pod in every tool namespace. All non-empty fields must
+// match for the rule to apply.
+type Selector struct {
+	// NamespaceRegex, if set, must match the pod's namespace.
+	NamespaceRegex string `json:"namespaceRegex,omitempty"`
+	// LabelSelector, if set, must be a subset of the pod's labels.
+	LabelSelector map[string]string `json:"labelSelector,omitempty"`
+	// ImageRegex, if set, must match at least one container image in the pod.
+	ImageRegex string `json:"imageRegex,omitempty"`
+
+	namespaceRegex *regexp.Regexp
+	imageRegex     *regexp.Regexp
+}
+
+// compile parses the regex fields of the selector so Matches can be called
+// repeatedly without recompiling them.
+func (s *Selector) compile() error {
+	if s.NamespaceRegex != "" {
+		r, err := regexp.Compile(s.NamespaceRegex)
+		if err != nil {
+			return fmt.Errorf("invalid namespaceRegex %q: %w", s.NamespaceRegex, err)
+		}
+		s.namespaceRegex = r
+	}
+
+	if s.ImageRegex != "" {
+		r, err := regexp.Compile(s.ImageRegex)
+		if err != nil {
+			return fmt.Errorf("invalid imageRegex %q: %w", s.ImageRegex, err)
+		}
+		s.imageRegex = r
+	}
+
+	return nil
+}
+
+// Matches reports whether the given pod in the given namespace satisfies
+// every field set on the selector.
+func (s *Selector) Matches(pod corev1.Pod, namespace string) bool {
+	if s.namespaceRegex != nil && !s.namespaceRegex.MatchString(namespace) {
+		return false
+	}
+
+	for key, value := range s.LabelSelector {
+		if pod.ObjectMeta.Labels[key] != value {
+			return false
+		}
+	}
+
+	if s.imageRegex != nil {
+		found := false
+		for _, container := range pod.Spec.Containers {
+			if s.imageRegex.MatchString(container.Image) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// VolumeSourceType selects which corev1.VolumeSource a Volume is backed by.
+type VolumeSourceType string
+
+const (
+	// VolumeSourceHostPath mounts a path from the node's filesystem, e.g. an
+	// NFS export bind-mounted onto every node. This is the default, and the
+	// only mode supported before Source was introduced.
+	VolumeSourceHostPath VolumeSourceType = "hostPath"
+	// VolumeSourcePVC mounts a PersistentVolumeClaim, optionally named per
+	// tool via PVCSource.ClaimNameTemplate.
+	VolumeSourcePVC VolumeSourceType = "persistentVolumeClaim"
+	// VolumeSourceCSI mounts an ephemeral CSI volume directly, without going
+	// through a PersistentVolumeClaim.
+	VolumeSourceCSI VolumeSourceType = "csi"
+)
+
+// PVCSource configures a Volume with Source == VolumeSourcePVC.
+type PVCSource struct {
+	// ClaimNameTemplate is a fmt.Sprintf pattern with a single %s verb that
+	// is replaced with the tool name, e.g. "tool-%s-home". If empty, the
+	// volume's own Name is used as the claim name verbatim.
+	ClaimNameTemplate string `json:"claimNameTemplate,omitempty"`
+}
+
+// CSISource configures a Volume with Source == VolumeSourceCSI.
+type CSISource struct {
+	// Driver is the name of the CSI driver to use, e.g. "nfs.csi.k8s.io".
+	Driver string `json:"driver"`
+	// VolumeAttributes are passed straight through to the CSI driver.
+	VolumeAttributes map[string]string `json:"volumeAttributes,omitempty"`
+}
+
+// Mutations describes the changes applied to a pod by a Rule that matches it.
+type Mutations struct {
+	// Volumes are added to the pod, and mounted into every container, the
+	// same way the legacy hard-coded Volumes list used to be.
+	Volumes []Volume `json:"volumes,omitempty"`
+	// Env is added to every container. A variable the container already
+	// sets, or that the webhook itself sets (HOME, TOOL_DATA_DIR), is
+	// replaced with the rule's value. If several matching rules set the same
+	// variable, the first one wins.
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// NodeSelector entries are added unless the pod already sets the same key.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations are appended unless the pod already has an identical one.
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// RemoveWorkingDir strips /spec/containers/*/workingDir from every
+	// container, letting the image's own default take over.
+	RemoveWorkingDir bool `json:"removeWorkingDir,omitempty"`
+	// Sidecars are injected into the pod, one container each, unless a
+	// container with the same name is already present. Gate injection to
+	// opted-in pods with the rule's selector, e.g.
+	// selector.labelSelector["toolforge.org/inject-logtail"] = "true".
+	Sidecars []Sidecar `json:"sidecars,omitempty"`
+	// Resources fills in missing container resource requests/limits and
+	// enforces the configured hard caps.
+	Resources *ResourceDefaults `json:"resources,omitempty"`
+	// PriorityClassName is set on the pod if it doesn't already have one.
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+	// RuntimeClassName is set on the pod if it doesn't already have one.
+	RuntimeClassName string `json:"runtimeClassName,omitempty"`
+	// PodSecurityContext fills in missing securityContext fields.
+	PodSecurityContext *PodSecurityContextDefaults `json:"podSecurityContext,omitempty"`
+}
+
+// ResourceDefaults configures the default requests/limits added to
+// containers that don't already set them, and the hard caps enforced on
+// every container regardless of what it asked for.
+type ResourceDefaults struct {
+	// Requests are added to a container's resources.requests for any
+	// resource name it doesn't already set.
+	Requests corev1.ResourceList `json:"requests,omitempty"`
+	// Limits are added to a container's resources.limits for any resource
+	// name it doesn't already set.
+	Limits corev1.ResourceList `json:"limits,omitempty"`
+	// MaxLimits are hard caps: a container whose resources.limits exceeds
+	// one of these, whether set explicitly or by a label override, causes
+	// the whole pod to be rejected.
+	MaxLimits corev1.ResourceList `json:"maxLimits,omitempty"`
+}
+
+// PodSecurityContextDefaults derives pod-level securityContext fields from
+// the tool's UID, as published via ToolUIDLabel by the kubeusers controller.
+type PodSecurityContextDefaults struct {
+	// RunAsUserFromUID sets securityContext.runAsUser from ToolUIDLabel if
+	// the pod doesn't already set it.
+	RunAsUserFromUID bool `json:"runAsUserFromUID,omitempty"`
+	// FSGroupFromUID sets securityContext.fsGroup from ToolUIDLabel if the
+	// pod doesn't already set it.
+	FSGroupFromUID bool `json:"fsGroupFromUID,omitempty"`
+}
+
+// Sidecar describes a helper container to inject into a matching pod, e.g. a
+// log tailer or a metrics exporter.
+type Sidecar struct {
+	Name         string                      `json:"name"`
+	Image        string                      `json:"image"`
+	Command      []string                    `json:"command,omitempty"`
+	Args         []string                    `json:"args,omitempty"`
+	Env          []corev1.EnvVar             `json:"env,omitempty"`
+	VolumeMounts []corev1.VolumeMount        `json:"volumeMounts,omitempty"`
+	Resources    corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Init, if true, injects the sidecar as an initContainer instead of a
+	// regular container.
+	Init bool `json:"init,omitempty"`
+}
+
+// asContainer builds the corev1.Container that should be patched into the pod.
+func (s Sidecar) asContainer() *corev1.Container {
+	return &corev1.Container{
+		Name:         s.Name,
+		Image:        s.Image,
+		Command:      s.Command,
+		Args:         s.Args,
+		Env:          s.Env,
+		VolumeMounts: s.VolumeMounts,
+		Resources:    s.Resources,
+	}
+}
+
+// Rule ties a Selector to the Mutations that should be applied when it matches.
+type Rule struct {
+	// Name is a human-readable identifier used in logs; it has no effect on
+	// matching or mutation.
+	Name      string    `json:"name"`
+	Selector  Selector  `json:"selector"`
+	Mutations Mutations `json:"mutations"`
+}
+
+// Config is the top level, file-backed configuration for VolumeAdmission. It
+// replaces the old hard-coded Volumes list with an ordered list of rules.
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// MatchingRules returns, in config order, the rules whose selector matches
+// the given pod.
+func (c *Config) MatchingRules(pod corev1.Pod, namespace string) []Rule {
+	var matched []Rule
+	for _, rule := range c.Rules {
+		if rule.Selector.Matches(pod, namespace) {
+			matched = append(matched, rule)
+		}
+	}
+
+	return matched
+}
+
+// LoadConfig reads and parses a rule configuration file. Both YAML and JSON
+// are accepted, since JSON is valid YAML; the file extension is not
+// inspected.
+func LoadConfig(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config %s: %w", path, err)
+	}
+
+	config := &Config{}
+	if err := yaml.Unmarshal(raw, config); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	for i := range config.Rules {
+		if err := config.Rules[i].Selector.compile(); err != nil {
+			name := config.Rules[i].Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i)
+			}
+			return nil, fmt.Errorf("rule %s: %w", name, err)
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func writeTempConfig(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("could not write temp config: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadConfigParsesRules(t *testing.T) {
+	path := writeTempConfig(t, `
+rules:
+  - name: home-volume
+    selector:
+      namespaceRegex: "^tool-.*"
+    mutations:
+      volumes:
+        - name: home
+          path: /data/project
+  - name: gpu-nodes
+    selector:
+      labelSelector:
+        toolforge.org/gpu: "true"
+    mutations:
+      nodeSelector:
+        accelerator: nvidia
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(config.Rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(config.Rules))
+	}
+
+	if config.Rules[0].Mutations.Volumes[0].Name != "home" {
+		t.Errorf("expected first rule to mount 'home', got %v", config.Rules[0].Mutations.Volumes)
+	}
+}
+
+func TestLoadConfigRejectsInvalidRegex(t *testing.T) {
+	path := writeTempConfig(t, `
+rules:
+  - name: broken
+    selector:
+      namespaceRegex: "("
+`)
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("expected an error for an invalid namespaceRegex, got none")
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("expected an error for a missing config file, got none")
+	}
+}
+
+func TestSelectorMatchesNamespaceRegex(t *testing.T) {
+	selector := Selector{NamespaceRegex: "^tool-foo$"}
+	if err := selector.compile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !selector.Matches(corev1.Pod{}, "tool-foo") {
+		t.Error("expected selector to match tool-foo")
+	}
+
+	if selector.Matches(corev1.Pod{}, "tool-bar") {
+		t.Error("expected selector not to match tool-bar")
+	}
+}
+
+func TestSelectorMatchesLabelSelector(t *testing.T) {
+	selector := Selector{LabelSelector: map[string]string{"toolforge.org/gpu": "true"}}
+
+	matching := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"toolforge.org/gpu": "true"}}}
+	if !selector.Matches(matching, "tool-foo") {
+		t.Error("expected selector to match pod with the label")
+	}
+
+	mismatching := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"toolforge.org/gpu": "false"}}}
+	if selector.Matches(mismatching, "tool-foo") {
+		t.Error("expected selector not to match pod with a different label value")
+	}
+
+	missing := corev1.Pod{}
+	if selector.Matches(missing, "tool-foo") {
+		t.Error("expected selector not to match pod missing the label entirely")
+	}
+}
+
+func TestSelectorMatchesImageRegex(t *testing.T) {
+	selector := Selector{ImageRegex: "python3.*"}
+	if err := selector.compile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		{Image: "docker-registry.tools.wmflabs.org/toolforge-python39-web:latest"},
+	}}}
+
+	if !selector.Matches(pod, "tool-foo") {
+		t.Error("expected selector to match a python image")
+	}
+
+	other := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		{Image: "docker-registry.tools.wmflabs.org/toolforge-ruby25-web:latest"},
+	}}}
+	if selector.Matches(other, "tool-foo") {
+		t.Error("expected selector not to match a non-python image")
+	}
+}
+
+func TestConfigMatchingRulesPreservesOrder(t *testing.T) {
+	config := &Config{
+		Rules: []Rule{
+			{Name: "first"},
+			{Name: "second", Selector: Selector{LabelSelector: map[string]string{"never": "matches"}}},
+			{Name: "third"},
+		},
+	}
+
+	matched := config.MatchingRules(corev1.Pod{}, "tool-foo")
+	if len(matched) != 2 {
+		t.Fatalf("expected 2 matching rules, got %d", len(matched))
+	}
+
+	if matched[0].Name != "first" || matched[1].Name != "third" {
+		t.Errorf("expected rules [first third], got %v", matched)
+	}
+}
+
+func TestVolumeSourceDefaultsToHostPath(t *testing.T) {
+	volume := Volume{Name: "home", Path: "/data/project", Type: corev1.HostPathDirectory}
+
+	source := volume.volumeSource("mytool")
+	if source.HostPath == nil || source.HostPath.Path != "/data/project" {
+		t.Errorf("expected a hostPath source for /data/project, got %+v", source)
+	}
+
+	if !volume.isNFSNodeBound() {
+		t.Error("expected a default (hostPath) volume to be NFS node bound")
+	}
+}
+
+func TestVolumeSourcePVCRendersClaimNameTemplate(t *testing.T) {
+	volume := Volume{
+		Name:   "home",
+		Source: VolumeSourcePVC,
+		PVC:    &PVCSource{ClaimNameTemplate: "tool-%s-home"},
+	}
+
+	source := volume.volumeSource("mytool")
+	if source.PersistentVolumeClaim == nil || source.PersistentVolumeClaim.ClaimName != "tool-mytool-home" {
+		t.Errorf("expected claim name tool-mytool-home, got %+v", source.PersistentVolumeClaim)
+	}
+
+	if volume.isNFSNodeBound() {
+		t.Error("expected a PVC-backed volume not to be NFS node bound")
+	}
+}
+
+func TestVolumeSourceCSIUsesDriverAndAttributes(t *testing.T) {
+	volume := Volume{
+		Name:   "home",
+		Source: VolumeSourceCSI,
+		CSI: &CSISource{
+			Driver:           "nfs.csi.k8s.io",
+			VolumeAttributes: map[string]string{"server": "nfs.example.org"},
+		},
+	}
+
+	source := volume.volumeSource("mytool")
+	if source.CSI == nil || source.CSI.Driver != "nfs.csi.k8s.io" {
+		t.Errorf("expected csi source with driver nfs.csi.k8s.io, got %+v", source.CSI)
+	}
+
+	if source.CSI.VolumeAttributes["server"] != "nfs.example.org" {
+		t.Errorf("expected volumeAttributes to be passed through, got %+v", source.CSI.VolumeAttributes)
+	}
+
+	if volume.isNFSNodeBound() {
+		t.Error("expected a CSI-backed volume not to be NFS node bound")
+	}
+}
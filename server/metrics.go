@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	admissionRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "volume_admission_requests_total",
+		Help: "Total number of AdmissionReviews handled, by decision.",
+	}, []string{"allowed"})
+
+	admissionDeniedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "volume_admission_denied_total",
+		Help: "Total number of denied AdmissionReviews, by reason.",
+	}, []string{"reason"})
+
+	admissionPatchOperations = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "volume_admission_patch_operations",
+		Help:    "Number of JSON patch operations returned per allowed AdmissionReview.",
+		Buckets: []float64{0, 1, 2, 4, 8, 16, 32, 64},
+	})
+
+	admissionRequestDurationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "volume_admission_request_duration_seconds",
+		Help:    "Time taken to handle an AdmissionReview.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// GetMetricsServer returns an http.Server exposing the above metrics at /metrics
+// in the Prometheus exposition format.
+func GetMetricsServer(listenAddr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return &http.Server{
+		Addr:    listenAddr,
+		Handler: mux,
+	}
+}
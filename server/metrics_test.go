@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// histogramSampleCount returns the number of observations h has recorded.
+func histogramSampleCount(t *testing.T, h prometheus.Histogram) uint64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := h.Write(&m); err != nil {
+		t.Fatalf("could not read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// admissionRequestsTotal, admissionDeniedTotal etc. are package-level
+// collectors registered once via promauto, so tests assert on the delta a
+// request causes rather than an absolute value.
+func TestRecordDecisionCountsAllowedRequest(t *testing.T) {
+	before := testutil.ToFloat64(admissionRequestsTotal.WithLabelValues("true"))
+	beforePatches := histogramSampleCount(t, admissionPatchOperations)
+
+	review, err := getResponse(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			env: []byte(`"env": [],`),
+		}),
+	})
+
+	assertAllowedAndGetPatch(review, err, t)
+
+	if got := testutil.ToFloat64(admissionRequestsTotal.WithLabelValues("true")); got != before+1 {
+		t.Errorf("admissionRequestsTotal{allowed=true} = %v, want %v", got, before+1)
+	}
+
+	if got := histogramSampleCount(t, admissionPatchOperations); got != beforePatches+1 {
+		t.Errorf("admissionPatchOperations sample count = %d, want %d", got, beforePatches+1)
+	}
+}
+
+func TestRecordDecisionCountsDeniedRequest(t *testing.T) {
+	before := testutil.ToFloat64(admissionDeniedTotal.WithLabelValues("non-tool-namespace"))
+
+	review, err := getResponse(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			namespace: "maintain-kubeusers",
+			env:       []byte(`"env": [],`),
+		}),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if review.Response.Allowed {
+		t.Fatal("Expected the request to be denied")
+	}
+
+	if got := testutil.ToFloat64(admissionDeniedTotal.WithLabelValues("non-tool-namespace")); got != before+1 {
+		t.Errorf("admissionDeniedTotal{reason=non-tool-namespace} = %v, want %v", got, before+1)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// AdmissionController is implemented by anything that can turn an incoming
+// AdmissionReview into a decision by populating its Response field.
+type AdmissionController interface {
+	HandleAdmission(review *admissionv1.AdmissionReview)
+}
+
+var admissionCodec = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+
+func admissionHandler(admission AdmissionController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logrus.Errorf("Could not read request body: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		review := &admissionv1.AdmissionReview{}
+		if _, _, err := admissionCodec.Decode(body, nil, review); err != nil {
+			logrus.Errorf("Could not decode AdmissionReview: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		admission.HandleAdmission(review)
+
+		response, err := json.Marshal(review)
+		if err != nil {
+			logrus.Errorf("Could not marshal AdmissionReview response: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(response); err != nil {
+			logrus.Errorf("Could not write response: %v", err)
+		}
+	}
+}
+
+// GetAdmissionControllerServerNoSsl returns an http.Server serving the given
+// AdmissionController over plain HTTP. It is primarily useful behind a
+// terminating proxy, or in tests.
+func GetAdmissionControllerServerNoSsl(admission AdmissionController, listenAddr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", admissionHandler(admission))
+
+	return &http.Server{
+		Addr:    listenAddr,
+		Handler: mux,
+	}
+}
+
+// GetAdmissionControllerServer returns an http.Server serving the given
+// AdmissionController, ready to be started with ListenAndServeTLS(certFile,
+// keyFile); the Kubernetes API server requires webhooks to be served over TLS.
+func GetAdmissionControllerServer(admission AdmissionController, listenAddr string) *http.Server {
+	return GetAdmissionControllerServerNoSsl(admission, listenAddr)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -9,27 +10,43 @@ import (
 	"strings"
 	"testing"
 
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/sirupsen/logrus"
 	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 )
 
-var (
-	volumes = []Volume{
+var testConfig = &Config{
+	Rules: []Rule{
 		{
-			Name:     "home",
-			Path:     "/data/project",
-			ReadOnly: false,
-		},
-		{
-			Name:     "etc-ldap",
-			Path:     "/etc/ldap",
-			ReadOnly: true,
+			Name: "default-volumes",
+			Mutations: Mutations{
+				Volumes: []Volume{
+					{
+						Name:     "home",
+						Path:     "/data/project",
+						ReadOnly: false,
+					},
+					{
+						Name:     "etc-ldap",
+						Path:     "/etc/ldap",
+						ReadOnly: true,
+					},
+				},
+			},
 		},
-	}
-)
+	},
+}
+
+func newTestAdmission() *VolumeAdmission {
+	admission := &VolumeAdmission{}
+	admission.config.Store(testConfig)
+	return admission
+}
 
 func decodeResponse(body io.ReadCloser) (*admissionv1.AdmissionReview, error) {
 	response, _ := io.ReadAll(body)
@@ -48,10 +65,10 @@ func encodeRequest(review *admissionv1.AdmissionReview) []byte {
 }
 
 func getResponse(request admissionv1.AdmissionReview) (*admissionv1.AdmissionReview, error) {
-	admission := &VolumeAdmission{
-		Volumes: volumes,
-	}
+	return getResponseWithAdmission(request, newTestAdmission())
+}
 
+func getResponseWithAdmission(request admissionv1.AdmissionReview, admission *VolumeAdmission) (*admissionv1.AdmissionReview, error) {
 	server := httptest.NewServer(GetAdmissionControllerServerNoSsl(admission, ":8080").Handler)
 	requestString := string(encodeRequest(&request))
 	myr := strings.NewReader(requestString)
@@ -64,6 +81,7 @@ type dummyRequestParams struct {
 	env          []byte
 	volumeMounts []byte
 	volumes      []byte
+	labels       map[string]string
 }
 
 func getDummyRequest(params dummyRequestParams) *admissionv1.AdmissionRequest {
@@ -72,16 +90,22 @@ func getDummyRequest(params dummyRequestParams) *admissionv1.AdmissionRequest {
 		namespace = "tool-test"
 	}
 
-	header := []byte(`{
+	labelsJSON, err := json.Marshal(params.labels)
+	if err != nil {
+		logrus.Errorln(err)
+	}
+
+	header := append([]byte(`{
 				"kind": "Pod",
 				"apiVersion": "v1",
 				"metadata": {
 					"name": "maintain-kubeusers-123123123",
 					"namespace": "maintain-kubeusers",
 					"uid": "4b54be10-8d3c-11e9-8b7a-080027f5f85c",
-					"creationTimestamp": "2019-06-12T18:02:51Z"
+					"creationTimestamp": "2019-06-12T18:02:51Z",
+					"labels": `), append(labelsJSON, []byte(`
 				},
-				"spec": {`)
+				"spec": {`)...)...)
 
 	volumeConfig := params.volumes
 	if volumeConfig == nil {
@@ -419,3 +443,571 @@ func TestServerRemovesWorkingDirIfNO_HOMESet(t *testing.T) {
 		t.Errorf("Did not find a patch that removed the WorkingDir entry among %s", p)
 	}
 }
+
+func newDuplicateEnvRuleTestAdmission() *VolumeAdmission {
+	admission := &VolumeAdmission{}
+	admission.config.Store(&Config{
+		Rules: []Rule{
+			{
+				Name: "first-foo",
+				Mutations: Mutations{
+					Env: []corev1.EnvVar{{Name: "FOO", Value: "from-first-rule"}},
+				},
+			},
+			{
+				Name: "second-foo",
+				Mutations: Mutations{
+					Env: []corev1.EnvVar{{Name: "FOO", Value: "from-second-rule"}},
+				},
+			},
+		},
+	})
+	return admission
+}
+
+func TestServerDedupesDuplicateRuleEnvAcrossRules(t *testing.T) {
+	admission := newDuplicateEnvRuleTestAdmission()
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			env: []byte(`"env": [],`),
+		}),
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	fooPatches := 0
+	for _, patch := range p {
+		value, ok := patch.Value.(map[string]interface{})
+		if !ok || value["name"] != "FOO" {
+			continue
+		}
+		fooPatches++
+		if value["value"] != "from-first-rule" {
+			t.Errorf("expected the first matching rule to win for FOO, got %v", value["value"])
+		}
+	}
+
+	if fooPatches != 1 {
+		t.Errorf("expected exactly one patch setting FOO, found %d among %s", fooPatches, p)
+	}
+}
+
+func TestServerRuleEnvOverridesAutoSetHOME(t *testing.T) {
+	admission := &VolumeAdmission{}
+	admission.config.Store(&Config{
+		Rules: []Rule{
+			{
+				Name: "override-home",
+				Mutations: Mutations{
+					Env: []corev1.EnvVar{{Name: "HOME", Value: "/override/home"}},
+				},
+			},
+		},
+	})
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			env: []byte(`"env": [],`),
+		}),
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	addHomeCount := 0
+	replacedHome := false
+	r, _ := regexp.Compile("/spec/containers/[0-9]*/env/-")
+	for _, patch := range p {
+		value, ok := patch.Value.(map[string]interface{})
+		if !ok || value["name"] != "HOME" {
+			continue
+		}
+		if r.Match([]byte(patch.Path)) {
+			addHomeCount++
+		}
+		if patch.Op == "replace" && value["value"] == "/override/home" {
+			replacedHome = true
+		}
+	}
+
+	if addHomeCount != 1 {
+		t.Errorf("expected exactly one add patch for HOME (the webhook default), found %d among %s", addHomeCount, p)
+	}
+	if !replacedHome {
+		t.Errorf("expected a replace patch overriding HOME with the rule's value among %s", p)
+	}
+}
+
+func newSidecarTestAdmission(sidecar Sidecar) *VolumeAdmission {
+	admission := &VolumeAdmission{}
+	admission.config.Store(&Config{
+		Rules: []Rule{
+			{
+				Name: "logtail-sidecar",
+				Selector: Selector{
+					LabelSelector: map[string]string{"toolforge.org/inject-logtail": "true"},
+				},
+				Mutations: Mutations{
+					Sidecars: []Sidecar{sidecar},
+				},
+			},
+		},
+	})
+	return admission
+}
+
+func hasContainerAddPatch(patches []PatchOperation, path string, name string) bool {
+	for _, patch := range patches {
+		if patch.Op != "add" || patch.Path != path {
+			continue
+		}
+		if value, ok := patch.Value.(map[string]interface{}); ok && value["name"] == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServerInjectsSidecarWhenLabelSet(t *testing.T) {
+	admission := newSidecarTestAdmission(Sidecar{Name: "logtail", Image: "logtail:latest"})
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			namespace: "tool-test",
+			labels:    map[string]string{"toolforge.org/inject-logtail": "true"},
+		}),
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	if !hasContainerAddPatch(p, "/spec/containers/-", "logtail") {
+		t.Errorf("Did not find a patch that injected the logtail sidecar among %s", p)
+	}
+}
+
+func TestServerDoesNotInjectSidecarWithoutLabel(t *testing.T) {
+	admission := newSidecarTestAdmission(Sidecar{Name: "logtail", Image: "logtail:latest"})
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request:  getDummyRequest(dummyRequestParams{namespace: "tool-test"}),
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	if hasContainerAddPatch(p, "/spec/containers/-", "logtail") {
+		t.Errorf("Found an unwanted logtail sidecar patch among %s", p)
+	}
+}
+
+func TestServerInjectsInitContainerSidecar(t *testing.T) {
+	admission := newSidecarTestAdmission(Sidecar{Name: "logtail-init", Image: "logtail:latest", Init: true})
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			namespace: "tool-test",
+			labels:    map[string]string{"toolforge.org/inject-logtail": "true"},
+		}),
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	if !hasContainerAddPatch(p, "/spec/initContainers/-", "logtail-init") {
+		t.Errorf("Did not find a patch that injected the logtail-init initContainer among %s", p)
+	}
+}
+
+func TestServerDoesNotDuplicateSidecarIfAlreadyPresent(t *testing.T) {
+	admission := newSidecarTestAdmission(Sidecar{Name: "logtail", Image: "logtail:latest"})
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID: "e911857d-c318-11e8-bbad-025000000001",
+			Kind: v1.GroupVersionKind{
+				Group: "", Version: "v1", Kind: "pod",
+			},
+			Operation: "CREATE",
+			Namespace: "tool-test",
+			Object: runtime.RawExtension{
+				Raw: []byte(`{
+					"kind": "Pod",
+					"apiVersion": "v1",
+					"metadata": {
+						"name": "test-123123123",
+						"namespace": "tool-test",
+						"uid": "4b54be10-8d3c-11e9-8b7a-080027f5f85c",
+						"creationTimestamp": "2019-06-12T18:02:51Z",
+						"labels": {"toolforge.org/inject-logtail": "true"}
+					},
+					"spec": {
+						"containers": [
+							{
+								"name": "test",
+								"image": "docker-registry.tools.wmflabs.org/toolforge-python39-web:latest",
+								"command": ["/usr/bin/webservice-runner"],
+								"args": ["python39"]
+							},
+							{
+								"name": "logtail",
+								"image": "logtail:latest"
+							}
+						]
+					}
+				}`),
+			},
+		},
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	if hasContainerAddPatch(p, "/spec/containers/-", "logtail") {
+		t.Errorf("Found a duplicate logtail sidecar patch among %s", p)
+	}
+}
+
+func TestServerInjectsSidecarUnderMountNone(t *testing.T) {
+	admission := newSidecarTestAdmission(Sidecar{Name: "logtail", Image: "logtail:latest"})
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			namespace: "tool-test",
+			labels: map[string]string{
+				"toolforge.org/inject-logtail": "true",
+				MountConfigLabel:               MountNone,
+			},
+		}),
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	if !hasContainerAddPatch(p, "/spec/containers/-", "logtail") {
+		t.Errorf("Expected the logtail sidecar to be injected even under mount-storage=none among %s", p)
+	}
+}
+
+func hasNodeSelectorPatch(patches []PatchOperation, path string) bool {
+	for _, patch := range patches {
+		if patch.Op == "add" && patch.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServerDoesNotRequireNFSNodeForPVCVolumes(t *testing.T) {
+	admission := &VolumeAdmission{}
+	admission.config.Store(&Config{
+		Rules: []Rule{
+			{
+				Name: "pvc-home",
+				Mutations: Mutations{
+					Volumes: []Volume{
+						{
+							Name:   "home",
+							Path:   "/data/project",
+							Source: VolumeSourcePVC,
+							PVC:    &PVCSource{ClaimNameTemplate: "tool-%s-home"},
+						},
+					},
+				},
+			},
+		},
+	})
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			namespace: "tool-test",
+			volumes:   []byte(`"volumes": [],`),
+		}),
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	if hasNodeSelectorPatch(p, "/spec/nodeSelector/kubernetes.wmcloud.org~1nfs-mounted") {
+		t.Errorf("Did not expect an nfs-mounted nodeSelector for a PVC-backed volume among %s", p)
+	}
+
+	for _, patch := range p {
+		if patch.Op != "add" || patch.Path != "/spec/volumes/-" {
+			continue
+		}
+		value, ok := patch.Value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		pvc, ok := value["persistentVolumeClaim"].(map[string]interface{})
+		if ok && pvc["claimName"] == "tool-test-home" {
+			return
+		}
+	}
+
+	t.Errorf("Did not find a patch mounting the tool-test-home PVC among %s", p)
+}
+
+func newResourceTestAdmission() *VolumeAdmission {
+	admission := &VolumeAdmission{}
+	admission.config.Store(&Config{
+		Rules: []Rule{
+			{
+				Name: "default-resources",
+				Mutations: Mutations{
+					Resources: &ResourceDefaults{
+						Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+						Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+						MaxLimits: corev1.ResourceList{
+							corev1.ResourceMemory: resource.MustParse("4Gi"),
+						},
+					},
+				},
+			},
+		},
+	})
+	return admission
+}
+
+func hasResourcePatch(patches []PatchOperation, path string) bool {
+	for _, patch := range patches {
+		if patch.Op == "add" && patch.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServerAddsDefaultResourcesWhenMissing(t *testing.T) {
+	admission := newResourceTestAdmission()
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request:  getDummyRequest(dummyRequestParams{}),
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	if !hasResourcePatch(p, "/spec/containers/0/resources/requests/memory") {
+		t.Errorf("Did not find a patch adding the default memory request among %s", p)
+	}
+	if !hasResourcePatch(p, "/spec/containers/0/resources/limits/memory") {
+		t.Errorf("Did not find a patch adding the default memory limit among %s", p)
+	}
+}
+
+// TestServerResourcePatchAppliesToContainerWithNoResourcesField guards
+// against a regression where the patches adding default resources assumed
+// the container already had a "resources" object in its raw JSON. The
+// dummy request fixture omits that field entirely, so applying the
+// generated patch to the original raw bytes is the real test: it would
+// fail with an "add operation does not apply" style error if the
+// "resources" object itself weren't added first.
+func TestServerResourcePatchAppliesToContainerWithNoResourcesField(t *testing.T) {
+	admission := newResourceTestAdmission()
+	request := getDummyRequest(dummyRequestParams{})
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request:  request,
+	}, admission)
+
+	assertAllowedAndGetPatch(review, err, t)
+
+	patch, err := jsonpatch.DecodePatch(review.Response.Patch)
+	if err != nil {
+		t.Fatalf("could not decode patch: %v", err)
+	}
+
+	if _, err := patch.Apply(request.Object.Raw); err != nil {
+		t.Errorf("patch adding default resources should apply cleanly to a container with no resources field: %v", err)
+	}
+}
+
+func TestServerMemLimitLabelOverridesDefault(t *testing.T) {
+	admission := newResourceTestAdmission()
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			labels: map[string]string{MemLimitLabel: "2Gi"},
+		}),
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	found := false
+	for _, patch := range p {
+		if patch.Path != "/spec/containers/0/resources/limits/memory" {
+			continue
+		}
+		if value, ok := patch.Value.(string); ok && value == "2Gi" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("Expected the %s label to override the default memory limit with 2Gi among %s", MemLimitLabel, p)
+	}
+}
+
+func TestServerRejectsMemLimitOverMaximum(t *testing.T) {
+	admission := newResourceTestAdmission()
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			labels: map[string]string{MemLimitLabel: "8Gi"},
+		}),
+	}, admission)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if review.Response.Allowed {
+		t.Error("Expected a pod requesting a memory limit over the hard cap to be rejected")
+	}
+}
+
+func TestServerRejectsMemLimitOverMaximumUnderMountNone(t *testing.T) {
+	admission := newResourceTestAdmission()
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			labels: map[string]string{MemLimitLabel: "8Gi", MountConfigLabel: MountNone},
+		}),
+	}, admission)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if review.Response.Allowed {
+		t.Error("Expected the resource hard cap to still be enforced for a pod with mount-storage=none")
+	}
+}
+
+func TestServerDerivesSecurityContextFromToolUIDLabel(t *testing.T) {
+	admission := &VolumeAdmission{}
+	admission.config.Store(&Config{
+		Rules: []Rule{
+			{
+				Name: "uid-derived-security-context",
+				Mutations: Mutations{
+					PodSecurityContext: &PodSecurityContextDefaults{
+						RunAsUserFromUID: true,
+						FSGroupFromUID:   true,
+					},
+				},
+			},
+		},
+	})
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			labels: map[string]string{ToolUIDLabel: "52382"},
+		}),
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	if !hasResourcePatch(p, "/spec/securityContext/runAsUser") {
+		t.Errorf("Did not find a patch setting runAsUser from %s among %s", ToolUIDLabel, p)
+	}
+	if !hasResourcePatch(p, "/spec/securityContext/fsGroup") {
+		t.Errorf("Did not find a patch setting fsGroup from %s among %s", ToolUIDLabel, p)
+	}
+}
+
+func TestServerDerivesSecurityContextUnderMountNone(t *testing.T) {
+	admission := &VolumeAdmission{}
+	admission.config.Store(&Config{
+		Rules: []Rule{
+			{
+				Name: "uid-derived-security-context",
+				Mutations: Mutations{
+					PodSecurityContext: &PodSecurityContextDefaults{
+						RunAsUserFromUID: true,
+						FSGroupFromUID:   true,
+					},
+				},
+			},
+		},
+	})
+
+	review, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request: getDummyRequest(dummyRequestParams{
+			labels: map[string]string{ToolUIDLabel: "52382", MountConfigLabel: MountNone},
+		}),
+	}, admission)
+
+	p := assertAllowedAndGetPatch(review, err, t)
+
+	if !hasResourcePatch(p, "/spec/securityContext/runAsUser") {
+		t.Errorf("Expected runAsUser to still be derived from %s under mount-storage=none among %s", ToolUIDLabel, p)
+	}
+	if !hasResourcePatch(p, "/spec/securityContext/fsGroup") {
+		t.Errorf("Expected fsGroup to still be derived from %s under mount-storage=none among %s", ToolUIDLabel, p)
+	}
+}
+
+func TestServerWritesAuditRecordOnAllow(t *testing.T) {
+	admission := newTestAdmission()
+
+	var buf bytes.Buffer
+	admission.Audit = NewAuditLogger(&buf)
+
+	_, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request:  getDummyRequest(dummyRequestParams{}),
+	}, admission)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var record AuditRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("could not unmarshal audit record: %v, raw: %s", err, buf.String())
+	}
+
+	if !record.Allowed {
+		t.Errorf("expected audit record to reflect an allowed request, got %+v", record)
+	}
+	if len(record.Patches) == 0 {
+		t.Errorf("expected audit record to include the patches applied, got %+v", record)
+	}
+}
+
+func TestServerWritesAuditRecordOnDeny(t *testing.T) {
+	admission := newTestAdmission()
+
+	var buf bytes.Buffer
+	admission.Audit = NewAuditLogger(&buf)
+
+	_, err := getResponseWithAdmission(admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{Kind: "AdmissionReview"},
+		Request:  getDummyRequest(dummyRequestParams{namespace: "maintain-kubeusers"}),
+	}, admission)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var record AuditRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("could not unmarshal audit record: %v, raw: %s", err, buf.String())
+	}
+
+	if record.Allowed {
+		t.Errorf("expected audit record to reflect a denied request, got %+v", record)
+	}
+	if record.Reason == "" {
+		t.Errorf("expected audit record to include a denial reason, got %+v", record)
+	}
+}